@@ -0,0 +1,171 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// secretFlags names the commandLineArgs flags whose values must never be
+// written to a backup manifest, which may be copied off-box alongside the
+// .bson dump it documents.
+var secretFlags = map[string]bool{
+	"-password":  true,
+	"--password": true,
+}
+
+// redactArgs returns a copy of args with the value of any flag in
+// secretFlags replaced by "REDACTED", for safe inclusion in a backup
+// manifest.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i, arg := range redacted {
+		name := arg
+		if eq := strings.IndexByte(arg, '='); eq >= 0 {
+			name = arg[:eq]
+		}
+		if !secretFlags[name] {
+			continue
+		}
+		if eq := strings.IndexByte(arg, '='); eq >= 0 {
+			redacted[i] = name + "=REDACTED"
+		} else if i+1 < len(redacted) {
+			redacted[i+1] = "REDACTED"
+		}
+	}
+	return redacted
+}
+
+// mgopurgeVersion identifies this build of mgopurge in backup manifests.
+const mgopurgeVersion = "unreleased"
+
+// backupManifest records enough information about a backup to restore it
+// with mongorestore and to understand what state the database was in when
+// the backup was taken.
+type backupManifest struct {
+	Version     string                     `json:"mgopurgeVersion"`
+	Args        []string                   `json:"args"`
+	BuildInfo   bson.M                     `json:"buildInfo"`
+	Collections map[string]collectionStats `json:"collections"`
+}
+
+// collectionStats summarises a single collection backed up to disk.
+type collectionStats struct {
+	Count  int    `json:"count"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupCollections dumps each of the named collections in db to a new
+// timestamped subdirectory of dir as mongorestore-compatible
+// <collection>.bson and <collection>.metadata.json files, alongside a
+// manifest.json recording
+// enough detail to revert the backup with mongorestore. This is essential
+// given that PurgeMissing, FixMachinesTxnQueue, PruneTxns and the
+// repairDatabase compaction make irreversible changes.
+func backupCollections(db *mgo.Database, dir string, collections []string) error {
+	collections = dedupeStrings(collections)
+
+	backupDir := filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z"))
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return fmt.Errorf("creating backup directory: %v", err)
+	}
+
+	var buildInfo bson.M
+	if err := db.Run("buildInfo", &buildInfo); err != nil {
+		return fmt.Errorf("fetching buildInfo: %v", err)
+	}
+
+	manifest := backupManifest{
+		Version:     mgopurgeVersion,
+		Args:        redactArgs(os.Args[1:]),
+		BuildInfo:   buildInfo,
+		Collections: make(map[string]collectionStats, len(collections)),
+	}
+	for _, name := range collections {
+		stats, err := backupCollection(db.C(name), backupDir, name)
+		if err != nil {
+			return fmt.Errorf("backing up %s: %v", name, err)
+		}
+		manifest.Collections[name] = stats
+	}
+
+	manifestPath := filepath.Join(backupDir, "manifest.json")
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(manifestPath, manifestData, 0600); err != nil {
+		return fmt.Errorf("writing manifest: %v", err)
+	}
+
+	logger.Infof("Backed up %d collections to %s (restore with: mongorestore --drop %s)",
+		len(collections), backupDir, backupDir)
+	return nil
+}
+
+// dedupeStrings returns ss with duplicate entries removed, preserving the
+// order of first occurrence.
+func dedupeStrings(ss []string) []string {
+	seen := make(map[string]bool, len(ss))
+	deduped := make([]string, 0, len(ss))
+	for _, s := range ss {
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		deduped = append(deduped, s)
+	}
+	return deduped
+}
+
+// backupCollection dumps a single collection to <dir>/<name>.bson and
+// <dir>/<name>.metadata.json, returning stats for the manifest.
+func backupCollection(coll *mgo.Collection, dir, name string) (collectionStats, error) {
+	bsonFile, err := os.OpenFile(filepath.Join(dir, name+".bson"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return collectionStats{}, err
+	}
+	defer bsonFile.Close()
+
+	hash := sha256.New()
+	var count int
+	var doc bson.Raw
+	iter := coll.Find(nil).Iter()
+	for iter.Next(&doc) {
+		if _, err := bsonFile.Write(doc.Data); err != nil {
+			return collectionStats{}, err
+		}
+		hash.Write(doc.Data)
+		count++
+	}
+	if err := iter.Close(); err != nil {
+		return collectionStats{}, err
+	}
+
+	metadata := bson.M{"options": bson.M{}, "indexes": []bson.M{}}
+	metadataData, err := json.Marshal(metadata)
+	if err != nil {
+		return collectionStats{}, err
+	}
+	metadataPath := filepath.Join(dir, name+".metadata.json")
+	if err := ioutil.WriteFile(metadataPath, metadataData, 0600); err != nil {
+		return collectionStats{}, err
+	}
+
+	return collectionStats{
+		Count:  count,
+		SHA256: fmt.Sprintf("%x", hash.Sum(nil)),
+	}, nil
+}
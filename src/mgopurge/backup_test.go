@@ -0,0 +1,67 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{
+			"separate value",
+			[]string{"-hostname", "db.example.com", "-password", "hunter2"},
+			[]string{"-hostname", "db.example.com", "-password", "REDACTED"},
+		},
+		{
+			"equals form",
+			[]string{"-password=hunter2", "-yes"},
+			[]string{"-password=REDACTED", "-yes"},
+		},
+		{
+			"double dash",
+			[]string{"--password", "hunter2"},
+			[]string{"--password", "REDACTED"},
+		},
+		{
+			"no secret flags",
+			[]string{"-hostname", "db.example.com", "-yes"},
+			[]string{"-hostname", "db.example.com", "-yes"},
+		},
+		{
+			"dangling flag with no value",
+			[]string{"-password"},
+			[]string{"-password"},
+		},
+	}
+	for _, test := range tests {
+		got := redactArgs(test.args)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: redactArgs(%v) = %v, want %v", test.name, test.args, got, test.want)
+		}
+	}
+}
+
+func TestDedupeStrings(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []string
+		want []string
+	}{
+		{"no duplicates", []string{"a", "b", "c"}, []string{"a", "b", "c"}},
+		{"duplicates preserve first occurrence order", []string{"a", "b", "a", "c", "b"}, []string{"a", "b", "c"}},
+		{"empty", nil, []string{}},
+	}
+	for _, test := range tests {
+		got := dedupeStrings(test.in)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: dedupeStrings(%v) = %v, want %v", test.name, test.in, got, test.want)
+		}
+	}
+}
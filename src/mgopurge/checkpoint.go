@@ -0,0 +1,280 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// checkpointsC is the collection mgopurge records its progress in, so that
+// an interrupted run can be resumed with -resume instead of restarting
+// from scratch.
+const checkpointsC = "mgopurge.checkpoints"
+
+// purgeBatchSize is the number of documents scanned between checkpoints
+// and progress log lines.
+const purgeBatchSize = 1000
+
+// checkpoint records how far the orphaned-transaction scan has got for a
+// single collection, so that -resume can continue from the last
+// successfully scanned document instead of rescanning the whole
+// collection.
+type checkpoint struct {
+	Collection string        `bson:"_id"`
+	Phase      string        `bson:"phase"`
+	LastID     bson.ObjectId `bson:"lastId,omitempty"`
+	Scanned    int           `bson:"scanned"`
+	Removed    int           `bson:"removed"`
+	Done       bool          `bson:"done"`
+	UpdatedAt  time.Time     `bson:"updatedAt"`
+}
+
+// txnQueueDoc is the subset of a purgeable collection's documents that
+// purgeCollectionBatched needs: its _id, for checkpointing, and its
+// txn-queue, to find tokens referring to transactions that no longer
+// exist.
+type txnQueueDoc struct {
+	Id    bson.ObjectId `bson:"_id"`
+	Queue []string      `bson:"txn-queue"`
+}
+
+// txnTokenIDLen is the length of the ObjectId-hex portion of a
+// gopkg.in/mgo.v2/txn token, e.g. "507f1f77bcf86cd799439011_01" for the
+// transaction with id 507f1f77bcf86cd799439011. ObjectId hex is always
+// exactly 24 characters, so it can be sliced directly regardless of
+// whatever separator and nonce format follows it.
+const txnTokenIDLen = 24
+
+// txnTokenID returns the ObjectId-hex id portion of a txn-queue token, or
+// "" if token is too short to contain one.
+func txnTokenID(token string) string {
+	if len(token) < txnTokenIDLen {
+		return ""
+	}
+	return token[:txnTokenIDLen]
+}
+
+// purgeMissingConcurrent scans collections for orphaned transaction queue
+// tokens, bounded by workers concurrent goroutines, checkpointing progress
+// in checkpointsC after every batch of purgeBatchSize documents (no
+// checkpoints are written when dryRun is true). If resume
+// is true, collections already marked done in a prior run are skipped
+// entirely, and partially-scanned collections resume from their recorded
+// LastID rather than restarting from the beginning. Each worker copies
+// session so that it has its own socket to the server, as required to use
+// mgo concurrently from multiple goroutines.
+func purgeMissingConcurrent(session *mgo.Session, dbName string, dryRun, resume bool, workers int, collections []string) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	db := session.DB(dbName)
+	checkpoints := db.C(checkpointsC)
+	liveIds, err := loadLiveTxnIds(db.C(txnsC), db.C(txnsStashC))
+	if err != nil {
+		return fmt.Errorf("loading live transaction ids: %v", err)
+	}
+
+	var pending []string
+	for _, name := range collections {
+		if resume {
+			var cp checkpoint
+			err := checkpoints.FindId(name).One(&cp)
+			if err == nil && cp.Done {
+				logger.Infof("Resuming: %s already purged, skipping", name)
+				continue
+			}
+		}
+		pending = append(pending, name)
+	}
+
+	jobs := make(chan string)
+	errs := make(chan error, len(pending))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			workerSession := session.Copy()
+			defer workerSession.Close()
+			checkpoints := workerSession.DB(dbName).C(checkpointsC)
+			for name := range jobs {
+				coll := workerSession.DB(dbName).C(name)
+				if err := purgeCollectionBatched(coll, checkpoints, liveIds, dryRun, resume, name); err != nil {
+					errs <- fmt.Errorf("%s: %v", name, err)
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, name := range pending {
+			jobs <- name
+		}
+		close(jobs)
+	}()
+	wg.Wait()
+	close(errs)
+
+	var firstErr error
+	for err := range errs {
+		logger.Errorf("PurgeMissing: %s", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// loadLiveTxnIds returns the set of transaction ids that still exist in
+// either txns or stash, as ObjectId hex strings. A txn-queue token whose id
+// is not in this set refers to a transaction that has been removed and is
+// therefore orphaned.
+func loadLiveTxnIds(txns, stash *mgo.Collection) (map[string]bool, error) {
+	live := make(map[string]bool)
+	for _, c := range []*mgo.Collection{txns, stash} {
+		var doc struct {
+			Id bson.ObjectId `bson:"_id"`
+		}
+		iter := c.Find(nil).Select(bson.M{"_id": 1}).Iter()
+		for iter.Next(&doc) {
+			live[doc.Id.Hex()] = true
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return live, nil
+}
+
+// purgeCollectionBatched scans coll in ascending _id order, purgeBatchSize
+// documents at a time, pulling any txn-queue token whose transaction id is
+// not in liveIds. After each batch it records a checkpoint with the last
+// _id scanned and logs scanned/removed progress with an ETA, so that a run
+// interrupted partway through a multi-million-document collection can
+// resume from where it left off instead of rescanning from the start.
+func purgeCollectionBatched(coll, checkpoints *mgo.Collection, liveIds map[string]bool, dryRun, resume bool, name string) error {
+	var scanned, removed, sessionScanned int
+	var lastID bson.ObjectId
+
+	if resume {
+		var cp checkpoint
+		if err := checkpoints.FindId(name).One(&cp); err == nil {
+			lastID = cp.LastID
+			scanned = cp.Scanned
+			removed = cp.Removed
+		}
+	}
+
+	total, err := coll.Find(nil).Count()
+	if err != nil {
+		return fmt.Errorf("counting %s: %v", name, err)
+	}
+
+	var sampleIds []interface{}
+	var estimatedBytes int64
+
+	start := time.Now()
+	for {
+		query := bson.M{}
+		if lastID != "" {
+			query["_id"] = bson.M{"$gt": lastID}
+		}
+		iter := coll.Find(query).Sort("_id").Limit(purgeBatchSize).Select(bson.M{"_id": 1, "txn-queue": 1}).Iter()
+
+		var doc txnQueueDoc
+		batchScanned := 0
+		batchRemoved := 0
+		for iter.Next(&doc) {
+			var orphaned []string
+			for _, token := range doc.Queue {
+				if !liveIds[txnTokenID(token)] {
+					orphaned = append(orphaned, token)
+				}
+			}
+			if len(orphaned) > 0 {
+				if dryRun {
+					if len(sampleIds) < maxDryRunSamples {
+						sampleIds = append(sampleIds, doc.Id)
+					}
+					for _, token := range orphaned {
+						estimatedBytes += int64(len(token))
+					}
+				} else if err := coll.UpdateId(doc.Id, bson.M{"$pullAll": bson.M{"txn-queue": orphaned}}); err != nil {
+					iter.Close()
+					return fmt.Errorf("pulling orphaned txn-queue entries from %s: %v", name, err)
+				}
+			}
+			lastID = doc.Id
+			batchScanned++
+			batchRemoved += len(orphaned)
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("scanning %s: %v", name, err)
+		}
+
+		scanned += batchScanned
+		sessionScanned += batchScanned
+		removed += batchRemoved
+
+		if !dryRun {
+			cp := checkpoint{
+				Collection: name,
+				Phase:      "PurgeMissing",
+				LastID:     lastID,
+				Scanned:    scanned,
+				Removed:    removed,
+				Done:       batchScanned < purgeBatchSize,
+				UpdatedAt:  time.Now(),
+			}
+			if _, cerr := checkpoints.UpsertId(name, cp); cerr != nil {
+				logger.Errorf("recording checkpoint for %s: %s", name, cerr)
+			}
+		}
+
+		elapsed := time.Since(start)
+		verb := "removed"
+		if dryRun {
+			verb = "would remove"
+		}
+		logger.Infof("%s: scanned %d/%d docs, %s %d orphaned txn-queue entries (%s elapsed, ETA %s)",
+			name, scanned, total, verb, removed, elapsed.Round(time.Second), estimateETA(sessionScanned, total-scanned, elapsed))
+
+		if batchScanned < purgeBatchSize {
+			break
+		}
+	}
+
+	if dryRun {
+		if err := emitDryRunReport(DryRunReport{
+			Phase: "PurgeMissing",
+			Collections: []CollectionReport{{
+				Name:                    name,
+				Count:                   removed,
+				SampleIds:               sampleIds,
+				EstimatedBytesReclaimed: estimatedBytes,
+			}},
+		}); err != nil {
+			return fmt.Errorf("emitting dry-run report for %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// estimateETA extrapolates, from how long it took to scan `scanned`
+// documents in this run, how much longer the `remaining` documents will
+// take. scanned and remaining must both exclude any progress carried over
+// from a previous -resume checkpoint, since only this run's elapsed time
+// is being measured.
+func estimateETA(scanned, remaining int, elapsed time.Duration) time.Duration {
+	if scanned == 0 || remaining <= 0 {
+		return 0
+	}
+	perDoc := elapsed / time.Duration(scanned)
+	return perDoc * time.Duration(remaining)
+}
@@ -0,0 +1,62 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTxnTokenID(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"507f1f77bcf86cd799439011_01", "507f1f77bcf86cd799439011"},
+		{"507f1f77bcf86cd799439011zz", "507f1f77bcf86cd799439011"},
+		{"507f1f77bcf86cd799439011", "507f1f77bcf86cd799439011"},
+		{"tooshort", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := txnTokenID(test.token); got != test.want {
+			t.Errorf("txnTokenID(%q) = %q, want %q", test.token, got, test.want)
+		}
+	}
+}
+
+func TestTxnTokenIDMatchesLiveIds(t *testing.T) {
+	// A live transaction whose id is in liveIds must not be misclassified
+	// as orphaned by its txn-queue token. This guards against a past bug
+	// where slicing off only the nonce (not also the separator) left a
+	// trailing "_" on the extracted id, so it could never match a bare
+	// ObjectId.Hex() in liveIds.
+	const id = "507f1f77bcf86cd799439011"
+	liveIds := map[string]bool{id: true}
+	token := id + "_01"
+	if !liveIds[txnTokenID(token)] {
+		t.Errorf("txnTokenID(%q) = %q, not found in liveIds[%q]", token, txnTokenID(token), id)
+	}
+}
+
+func TestEstimateETA(t *testing.T) {
+	tests := []struct {
+		name      string
+		scanned   int
+		remaining int
+		elapsed   time.Duration
+		want      time.Duration
+	}{
+		{"no progress yet", 0, 100, time.Minute, 0},
+		{"nothing left", 100, 0, time.Minute, 0},
+		{"linear extrapolation", 50, 50, time.Minute, time.Minute},
+		{"half rate", 100, 50, 2 * time.Minute, time.Minute},
+	}
+	for _, test := range tests {
+		if got := estimateETA(test.scanned, test.remaining, test.elapsed); got != test.want {
+			t.Errorf("%s: estimateETA(%d, %d, %s) = %s, want %s",
+				test.name, test.scanned, test.remaining, test.elapsed, got, test.want)
+		}
+	}
+}
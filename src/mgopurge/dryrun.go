@@ -0,0 +1,90 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// txnStateApplied and txnStateAborted are the gopkg.in/mgo.v2/txn states
+// for transactions that have finished and are therefore candidates for
+// pruning. See gopkg.in/mgo.v2/txn for the full state machine.
+const (
+	txnStateAborted = 4
+	txnStateApplied = 6
+)
+
+// maxDryRunSamples bounds how many sample document IDs are included per
+// collection in a dry-run report, so the report stays readable against
+// collections with millions of matching documents.
+const maxDryRunSamples = 10
+
+// DryRunReport describes the changes a phase of mgopurge would make to the
+// database, without making them. It is emitted as JSON to stdout when
+// -dry-run is given.
+type DryRunReport struct {
+	Phase       string             `json:"phase"`
+	Collections []CollectionReport `json:"collections,omitempty"`
+}
+
+// CollectionReport summarises the documents a phase would modify or remove
+// in a single collection.
+type CollectionReport struct {
+	Name                    string        `json:"name"`
+	Count                   int           `json:"count"`
+	SampleIds               []interface{} `json:"sampleIds,omitempty"`
+	EstimatedBytesReclaimed int64         `json:"estimatedBytesReclaimed,omitempty"`
+}
+
+// emitDryRunReport writes report to stdout as indented JSON.
+func emitDryRunReport(report DryRunReport) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// reportPrunableTxns computes and emits a DryRunReport describing the
+// applied and aborted transactions in txns, without removing them. It
+// counts every such transaction whether or not a txn-queue still
+// references it, so the report can include transactions that PruneTxns
+// leaves in place.
+func reportPrunableTxns(txns *mgo.Collection) error {
+	query := txns.Find(bson.M{"s": bson.M{"$in": []int{txnStateAborted, txnStateApplied}}})
+
+	var sampleIds []interface{}
+	var count int
+	var estimatedBytes int64
+	var doc bson.Raw
+	iter := query.Iter()
+	for iter.Next(&doc) {
+		count++
+		estimatedBytes += int64(len(doc.Data))
+		if len(sampleIds) < maxDryRunSamples {
+			var idDoc struct {
+				Id interface{} `bson:"_id"`
+			}
+			if err := doc.Unmarshal(&idDoc); err != nil {
+				iter.Close()
+				return err
+			}
+			sampleIds = append(sampleIds, idDoc.Id)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return emitDryRunReport(DryRunReport{
+		Phase: "PruneTxns",
+		Collections: []CollectionReport{{
+			Name:                    txnsC,
+			Count:                   count,
+			SampleIds:               sampleIds,
+			EstimatedBytesReclaimed: estimatedBytes,
+		}},
+	})
+}
@@ -6,11 +6,14 @@ package main
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
 	"strings"
+	"time"
 
 	jujutxn "github.com/juju/txn"
 	"gopkg.in/mgo.v2"
@@ -47,31 +50,50 @@ func main() {
 	collections := getAllPurgeableCollections(db)
 	txns := db.C(txnsC)
 
+	if args.dryRun {
+		logger.Infof("Dry run: no changes will be made to %q", db.Name)
+	} else if args.backupDir != "" {
+		logger.Infof("Backing up %s, %s, %s and %d purgeable collections to %s...",
+			txnsC, txnsStashC, machinesC, len(collections), args.backupDir)
+		toBackup := append([]string{txnsC, txnsStashC, machinesC}, collections...)
+		err = backupCollections(db, args.backupDir, toBackup)
+		checkErr("BackupCollections", err)
+	}
+
 	logger.Infof("Repairing runaway transactions for apiHostPorts document...")
-	err = FixApiHostPorts(db, txns)
+	err = FixApiHostPorts(db, txns, args.dryRun)
 	checkErr("FixApiHostPorts", err)
 
-	logger.Infof("Purging orphaned transactions for %d juju collections...\n", len(collections))
-	err = PurgeMissing(txns, db.C(txnsStashC), collections...)
+	logger.Infof("Purging orphaned transactions for %d juju collections using %d worker(s)...\n",
+		len(collections), args.workers)
+	err = purgeMissingConcurrent(session, db.Name, args.dryRun, args.resume, args.workers, collections)
 	checkErr("PurgeMissing", err)
 	logger.Infof("Done compacting orphaned transactions.")
 
 	if args.doMachines {
 		logger.Infof("Removing references to completed transactions in machines collection...")
-		err = FixMachinesTxnQueue(db.C(machinesC), txns)
+		err = FixMachinesTxnQueue(db.C(machinesC), txns, args.dryRun)
 		checkErr("FixMachinesTxnQueue", err)
 	}
 
 	if args.doPrune {
 		logger.Infof("Pruning unreferenced transactions...")
-		err = jujutxn.PruneTxns(db, txns)
+		if args.dryRun {
+			err = reportPrunableTxns(txns)
+		} else {
+			err = jujutxn.PruneTxns(db, txns)
+		}
 		checkErr("PruneTxns", err)
 	}
 
 	if args.doCompcact {
-		logger.Infof("Compacting database to release disk space...")
-		err = db.Run(bson.M{"repairDatabase": 1}, nil)
-		checkErr("repairDatabase", err)
+		if args.dryRun {
+			logger.Infof("Dry run: skipping repairDatabase")
+		} else {
+			logger.Infof("Compacting database to release disk space...")
+			err = db.Run(bson.M{"repairDatabase": 1}, nil)
+			checkErr("repairDatabase", err)
+		}
 	}
 }
 
@@ -96,8 +118,11 @@ func printAndFlush(s string) {
 }
 
 func dial(args commandLineArgs) (*mgo.Session, error) {
+	addrs := append([]string{net.JoinHostPort(args.hostname, args.port)}, args.seeds...)
 	info := &mgo.DialInfo{
-		Addrs: []string{net.JoinHostPort(args.hostname, args.port)},
+		Addrs:          addrs,
+		ReplicaSetName: args.replicaSet,
+		Timeout:        args.syncTimeout,
 	}
 	if args.username != "" {
 		info.Database = "admin"
@@ -105,28 +130,85 @@ func dial(args commandLineArgs) (*mgo.Session, error) {
 		info.Password = args.password
 	}
 	if args.ssl {
-		info.DialServer = dialSSL
+		tlsConfig, err := tlsConfigFromArgs(args)
+		if err != nil {
+			return nil, err
+		}
+		info.DialServer = DialServer(tlsConfig)
 	}
 	session, err := mgo.DialWithInfo(info)
 	if err != nil {
 		return nil, err
 	}
+	session.SetMode(mgo.Strong, true)
+	session.SetSocketTimeout(args.socketTimeout)
+	session.SetSyncTimeout(args.syncTimeout)
+
+	if args.replicaSet != "" {
+		if err := confirmPrimary(session); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("confirming replica set primary: %v", err)
+		}
+	}
 	return session, nil
 }
 
-func dialSSL(addr *mgo.ServerAddr) (net.Conn, error) {
-	c, err := net.Dial("tcp", addr.String())
-	if err != nil {
-		return nil, err
-	}
+// jujuMongoServerName is the fixed server name Juju's own mongo certificates
+// are issued for, independent of the controller's actual address. It must
+// be used as the TLS ServerName regardless of -hostname, since that address
+// is dynamic (DNS name, IP, or load balancer) and never appears in the
+// certificate itself.
+const jujuMongoServerName = "juju-mongodb"
+
+// tlsConfigFromArgs builds the tls.Config used to verify the connection to
+// the Juju MongoDB server. Unless -insecure-skip-verify is given, the
+// server's certificate is verified against the CA certificate given with
+// -ca-cert (the Juju controller's CA), mirroring how Juju's own mgo dial
+// code establishes a verified TLS connection to mongod. Without -ca-cert,
+// the system's root CAs are used for verification.
+func tlsConfigFromArgs(args commandLineArgs) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+		InsecureSkipVerify: args.insecureSkipVerify,
+		ServerName:         jujuMongoServerName,
 	}
-	cc := tls.Client(c, tlsConfig)
-	if err := cc.Handshake(); err != nil {
-		return nil, err
+	if args.insecureSkipVerify {
+		return tlsConfig, nil
+	}
+	if args.caCertPath != "" {
+		pemData, err := ioutil.ReadFile(args.caCertPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificate: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pemData) {
+			return nil, fmt.Errorf("no certificates found in %s", args.caCertPath)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if args.clientCertPath != "" || args.clientKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(args.clientCertPath, args.clientKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// DialServer returns an mgo.DialInfo.DialServer function that dials over
+// TLS using the given configuration.
+func DialServer(tlsConfig *tls.Config) func(addr *mgo.ServerAddr) (net.Conn, error) {
+	return func(addr *mgo.ServerAddr) (net.Conn, error) {
+		c, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			return nil, err
+		}
+		cc := tls.Client(c, tlsConfig)
+		if err := cc.Handshake(); err != nil {
+			return nil, err
+		}
+		return cc, nil
 	}
-	return cc, nil
 }
 
 func checkErr(label string, err error) {
@@ -137,15 +219,27 @@ func checkErr(label string, err error) {
 }
 
 type commandLineArgs struct {
-	hostname   string
-	port       string
-	ssl        bool
-	username   string
-	password   string
-	doPrompt   bool
-	doMachines bool
-	doPrune    bool
-	doCompcact bool
+	hostname           string
+	port               string
+	ssl                bool
+	username           string
+	password           string
+	caCertPath         string
+	clientCertPath     string
+	clientKeyPath      string
+	insecureSkipVerify bool
+	doPrompt           bool
+	doMachines         bool
+	doPrune            bool
+	doCompcact         bool
+	dryRun             bool
+	backupDir          string
+	replicaSet         string
+	seeds              []string
+	socketTimeout      time.Duration
+	syncTimeout        time.Duration
+	workers            int
+	resume             bool
 }
 
 func commandLine() commandLineArgs {
@@ -161,6 +255,14 @@ func commandLine() commandLineArgs {
 		"user for connecting to MonogDB (use \"\" to for no authentication)")
 	flags.StringVar(&a.password, "password", "",
 		"password for connecting to MonogDB")
+	flags.StringVar(&a.caCertPath, "ca-cert", "",
+		"path to the CA certificate used to verify the MongoDB server (PEM)")
+	flags.StringVar(&a.clientCertPath, "client-cert", "",
+		"path to the client certificate used to authenticate to the MongoDB server (PEM)")
+	flags.StringVar(&a.clientKeyPath, "client-key", "",
+		"path to the private key matching -client-cert (PEM)")
+	flags.BoolVar(&a.insecureSkipVerify, "insecure-skip-verify", false,
+		"do not verify the MongoDB server's certificate (insecure)")
 	yes := flags.Bool("yes", false, "answer 'yes' to prompts")
 	noMachines := flags.Bool("no-machines", false,
 		"skip removal of completed txn-queue entries from machines collection")
@@ -168,6 +270,23 @@ func commandLine() commandLineArgs {
 		"skip pruning of completed transactions")
 	noCompact := flags.Bool("no-compact", false,
 		"skip compacting of database")
+	flags.BoolVar(&a.dryRun, "dry-run", false,
+		"report the changes each phase would make, without touching the database")
+	flags.StringVar(&a.backupDir, "backup-dir", "",
+		"directory to dump txns, txns.stash, machines and purgeable collections to before making any changes")
+	flags.StringVar(&a.replicaSet, "replica-set", "",
+		"name of the replica set to connect to, for a replicated Juju MongoDB server")
+	var seeds seedsFlag
+	flags.Var(&seeds, "seed",
+		"additional replica set member to seed the connection with (may be repeated)")
+	flags.DurationVar(&a.socketTimeout, "socket-timeout", time.Minute,
+		"socket read/write timeout for the MongoDB connection")
+	flags.DurationVar(&a.syncTimeout, "sync-timeout", time.Minute,
+		"timeout for synchronising with the replica set topology")
+	flags.IntVar(&a.workers, "workers", 1,
+		"number of collections to scan for orphaned transactions concurrently")
+	flags.BoolVar(&a.resume, "resume", false,
+		"resume PurgeMissing from the mgopurge.checkpoints collection, skipping collections already completed")
 
 	flags.Parse(os.Args[1:])
 
@@ -179,6 +298,7 @@ func commandLine() commandLineArgs {
 	a.doMachines = !*noMachines
 	a.doPrune = !*noPrune
 	a.doCompcact = !*noCompact
+	a.seeds = []string(seeds)
 	return a
 }
 
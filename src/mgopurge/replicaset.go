@@ -0,0 +1,63 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package main
+
+import (
+	"fmt"
+
+	"gopkg.in/mgo.v2"
+)
+
+// seedsFlag accumulates repeated -seed flag values into a slice of
+// additional replica set members to dial.
+type seedsFlag []string
+
+func (s *seedsFlag) String() string {
+	return fmt.Sprint([]string(*s))
+}
+
+func (s *seedsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// replSetStatus is the subset of the replSetGetStatus reply that
+// confirmPrimary needs to identify the primary.
+type replSetStatus struct {
+	Members []replSetMember `bson:"members"`
+}
+
+type replSetMember struct {
+	Name     string `bson:"name"`
+	StateStr string `bson:"stateStr"`
+	Self     bool   `bson:"self"`
+}
+
+// confirmPrimary checks, via replSetGetStatus, that session is connected to
+// the replica set's PRIMARY member. mgopurge must write directly to the
+// primary, so if the caller pointed it at a secondary this returns an error
+// naming the member that is actually primary instead of silently failing
+// every write later on.
+func confirmPrimary(session *mgo.Session) error {
+	var status replSetStatus
+	if err := session.Run("replSetGetStatus", &status); err != nil {
+		return fmt.Errorf("replSetGetStatus: %v", err)
+	}
+	var primary, self string
+	for _, m := range status.Members {
+		if m.StateStr == "PRIMARY" {
+			primary = m.Name
+		}
+		if m.Self {
+			self = m.Name
+		}
+	}
+	if self == "" || self != primary {
+		if primary == "" {
+			return fmt.Errorf("replica set has no PRIMARY member")
+		}
+		return fmt.Errorf("connected to %s, which is not the PRIMARY; PRIMARY is %s", self, primary)
+	}
+	return nil
+}